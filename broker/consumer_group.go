@@ -20,42 +20,150 @@ var (
 )
 
 type ConsumerGroup struct {
-	broker    *Broker
-	topic     string
-	partition string
-	name      string
-	mu        sync.RWMutex
-	receivers []*receiver
+	broker      *Broker
+	topic       string
+	partition   string
+	name        string
+	coordinator *GroupCoordinator
+	offsetStore OffsetStore
+	autoCommit  AutoCommitConfig
+	retryPolicy RetryPolicy
+	stopCh      chan struct{}
+	mu          sync.RWMutex
+	receivers   []*receiver
+	paused      bool
+	pauseGate   chan struct{}
+
+	// ordered is non-nil once ConsumeOrdered has been called, switching
+	// the dispatch loop from round-robin to per-key rendezvous routing.
+	ordered *orderedDispatcher
 }
 
 func NewConsumerGroup(b *Broker, topic, partition, name string) *ConsumerGroup {
-	return &ConsumerGroup{
-		broker:    b,
-		name:      name,
-		topic:     topic,
-		partition: partition,
+	pauseGate := make(chan struct{})
+	close(pauseGate) // closed == not paused, so reads never block
+
+	coordinator, createdCoordinator := acquireGroupCoordinator(b, topic, name)
+
+	c := &ConsumerGroup{
+		broker:      b,
+		name:        name,
+		topic:       topic,
+		partition:   partition,
+		coordinator: coordinator,
+		offsetStore: NewLocalOffsetStore(b),
+		autoCommit:  DefaultAutoCommitConfig,
+		retryPolicy: DefaultRetryPolicy,
+		stopCh:      make(chan struct{}),
+		pauseGate:   pauseGate,
 	}
+
+	// Every partition of (topic, name) shares one coordinator, so only
+	// the ConsumerGroup that actually created it should drive its
+	// membership sync; the rest would just be redundant tickers hitting
+	// the same coordinator.
+	if createdCoordinator {
+		go c.coordinator.startMembershipSync(c.stopCh)
+	}
+	c.coordinator.AddPartition(partition)
+
+	go c.startAutoCommit(c.autoCommit, c.stopCh)
+
+	return c
+}
+
+// SetRetryPolicy replaces the group's RetryPolicy. The new policy is
+// used from the next redelivery check on, for every message; no policy
+// is stored alongside a message's mark state.
+func (c *ConsumerGroup) SetRetryPolicy(p RetryPolicy) {
+	c.mu.Lock()
+	c.retryPolicy = p
+	c.mu.Unlock()
+}
+
+// Pause stops the group from dispatching any further messages for
+// (topic, partition) until Resume is called, letting an application
+// throttle itself instead of relying solely on per-receiver watermarks.
+func (c *ConsumerGroup) Pause(topic, partition string) error {
+	if topic != c.topic || partition != c.partition {
+		return status.Errorf(codes.InvalidArgument, "this group is not consuming %s/%s", topic, partition)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		return nil
+	}
+	c.paused = true
+	c.pauseGate = make(chan struct{})
+	return nil
+}
+
+// Resume undoes a prior Pause, letting dispatch continue for (topic,
+// partition).
+func (c *ConsumerGroup) Resume(topic, partition string) error {
+	if topic != c.topic || partition != c.partition {
+		return status.Errorf(codes.InvalidArgument, "this group is not consuming %s/%s", topic, partition)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.paused {
+		return nil
+	}
+	c.paused = false
+	close(c.pauseGate)
+	return nil
+}
+
+// Close stops the group's background auto-commit goroutine and removes
+// this partition from the shared coordinator for (topic, name), which
+// rebalances the group without it. It does not close or unregister any
+// currently registered receivers.
+func (c *ConsumerGroup) Close() {
+	select {
+	case <-c.stopCh:
+	default:
+		close(c.stopCh)
+	}
+	c.coordinator.RemovePartition(c.partition)
+	releaseGroupCoordinator(c.topic, c.name)
 }
 
 type receiver struct {
 	name   string
-	msgCh  chan *sgproto.Message
+	queue  *ProcessQueue
 	doneCh chan struct{}
+	events <-chan GroupEvent
+	filter CompiledFilter
+
+	// broadcast is true for a Subscribe receiver: unlike a Consume
+	// receiver, which competes for a share of the round-robin rotation,
+	// a broadcast receiver gets its own copy of every message that
+	// matches its filter, independently of every other receiver.
+	broadcast bool
 }
 
-func (c *ConsumerGroup) register(consumerName string) *receiver {
+func (c *ConsumerGroup) register(consumerName string, protocols []RebalanceProtocol, prefetchCount int, filter CompiledFilter, broadcast bool) *receiver {
 	r := c.getReceiver(consumerName)
 	if r != nil {
 		return r
 	}
 
+	if filter == nil {
+		filter = matchAllFilter{}
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	r = &receiver{
-		name:   consumerName,
-		msgCh:  make(chan *sgproto.Message),
-		doneCh: make(chan struct{}),
+		name:      consumerName,
+		queue:     NewProcessQueue(prefetchCount),
+		doneCh:    make(chan struct{}),
+		events:    c.coordinator.Join(consumerName, protocols),
+		filter:    filter,
+		broadcast: broadcast,
 	}
 	c.receivers = append(c.receivers, r)
 
@@ -70,7 +178,7 @@ func (c *ConsumerGroup) consumeLoop() {
 	defer func() { // close receivers for whatever reason
 		c.mu.Lock()
 		for _, r := range c.receivers {
-			close(r.msgCh)
+			close(r.queue.out)
 			close(r.doneCh)
 		}
 		c.receivers = c.receivers[:0]
@@ -98,6 +206,7 @@ func (c *ConsumerGroup) consumeLoop() {
 				lastMessage *sgproto.Message
 				committed   = false
 			)
+
 			req := &sgproto.FetchRangeRequest{
 				Topic:     c.topic,
 				Partition: c.partition,
@@ -106,8 +215,11 @@ func (c *ConsumerGroup) consumeLoop() {
 			}
 
 			commit := func(offset sandflake.ID) {
-				_, err := c.broker.Commit(context.TODO(), c.topic, c.partition, c.name, "", lastMessage.Offset)
-				if err != nil {
+				if err := c.offsetStore.UpdateOffset(context.TODO(), c.offsetKey(), offset, ""); err != nil {
+					c.broker.Debug("unable to update offset: %v", err)
+					return
+				}
+				if err := c.offsetStore.Persist(context.TODO(), c.offsetKey()); err != nil {
 					c.broker.Debug("unable to commit")
 				}
 			}
@@ -145,13 +257,30 @@ func (c *ConsumerGroup) consumeLoop() {
 							commit(lastMessage.Offset)
 						}
 						committed = true
-					} else if i%10000 == 0 {
-						go commit(lastMessage.Offset)
+					} else if err := c.offsetStore.UpdateOffset(context.TODO(), c.offsetKey(), lastMessage.Offset, ""); err != nil {
+						// nothing was buffered for this offset; the next acked
+						// message's update or the final commit supersedes it
+						c.broker.Debug("unable to update offset: %v", err)
 					}
 				}
 				lastMessage = m
 
-				if shouldRedeliver(m.Index, state) {
+				redeliver := shouldRedeliver(m.Index, state, c.retryPolicy)
+
+				// exhausted is consulted for every redelivery, not just
+				// explicit NACKs: a message stuck in Consumed (e.g. a
+				// crashed or hung consumer that never acks or nacks) has
+				// DeliveryCount incremented on each timeout-based
+				// redelivery exactly like the NACK path, so it
+				// dead-letters the same way once it reaches
+				// MaxDeliveryAttempts. A message with no mark state at
+				// all (Unknown) has no count recorded, so it is
+				// redelivered on timeout without ever dead-lettering.
+				if redeliver && c.retryPolicy.exhausted(state) {
+					return c.sendToDeadLetter(context.TODO(), m, msg, state)
+				}
+
+				if redeliver {
 					msgCh <- m // deliver
 
 					if state.Kind != sgproto.MarkKind_Unknown {
@@ -185,6 +314,7 @@ func (c *ConsumerGroup) consumeLoop() {
 	}
 	group.Go(func() error {
 		now := sandflake.NewID(time.Now().UTC(), sandflake.MaxID.WorkerID(), sandflake.MaxID.Sequence(), sandflake.MaxID.RandomBytes())
+
 		req := &sgproto.FetchRangeRequest{
 			Topic:     c.topic,
 			Partition: c.partition,
@@ -214,15 +344,62 @@ func (c *ConsumerGroup) consumeLoop() {
 
 	var i int
 	var m *sgproto.Message
+	var generation uint64
 loop:
 	for m = range msgCh {
+		c.mu.RLock()
+		gate := c.pauseGate
+		ordered := c.ordered
+		c.mu.RUnlock()
+		<-gate // blocks only while the group is manually paused
+
+		generation = c.waitForPartitionOwnership()
+
+		c.dispatchBroadcast(m)
+
+		if ordered != nil {
+			ordered.dispatch(m)
+			continue
+		}
+
 		// select receiver
+		attempts := 0
 	selectreceiver:
 		i++
 		c.mu.RLock()
-		r := c.receivers[i%len(c.receivers)]
+		n := len(c.receivers)
+		r := c.receivers[i%n]
 		c.mu.RUnlock()
 
+		// broadcast receivers already got their copy above via
+		// dispatchBroadcast; they never take a turn in the round-robin
+		// rotation used by competing Consume receivers.
+		if r.broadcast {
+			attempts++
+			if attempts < n {
+				goto selectreceiver
+			}
+			continue
+		}
+
+		// a receiver whose filter rejects m never gets it, regardless of
+		// how many times we cycle through the group.
+		if !r.filter.Match(m) {
+			attempts++
+			if attempts < n {
+				goto selectreceiver
+			}
+			continue // nobody's filter matched this message
+		}
+
+		// skip receivers whose queue is over its high watermark, unless
+		// we've already cycled through everyone once: better to deliver
+		// late to a busy receiver than to drop the message.
+		if attempts < n && r.queue.ShouldPause() {
+			attempts++
+			goto selectreceiver
+		}
+
 		select {
 		case <-r.doneCh:
 			if c.removeConsumer(r.name) {
@@ -236,24 +413,74 @@ loop:
 
 				goto selectreceiver // select another receiver
 			}
-		case r.msgCh <- m:
+		case r.queue.out <- m:
 		}
 	}
 
 	if m != nil && !m.Offset.Equal(from) {
-		_, err := c.broker.MarkConsumed(context.TODO(), c.topic, c.partition, c.name, "REMOVE THIS", m.Offset)
-		if err != nil {
+		if !c.coordinator.ValidGeneration(generation) {
+			// a rebalance moved this partition away from us while m was
+			// in flight; the new owner is the one whose mark should win.
+			c.broker.Debug("skipping mark-consumed for %s/%s: generation %d is no longer current", c.topic, c.partition, generation)
+		} else if _, err := c.broker.MarkConsumed(context.TODO(), c.topic, c.partition, c.name, c.name, m.Offset); err != nil {
 			c.broker.Debug("unable to mark as consumed: %v", err)
 		}
 	}
 }
 
-func shouldRedeliver(index sandflake.ID, state sgproto.MarkState) bool {
+// waitForPartitionOwnership blocks while c.partition is currently
+// assigned, by the shared GroupCoordinator for this topic, to a member
+// that isn't one of this ConsumerGroup's own receivers -- e.g. because
+// it was rebalanced onto a consumer running in a different process. An
+// unassigned partition (no rebalance has run yet, such as before the
+// first Join) is treated as free to dispatch, preserving the original
+// behavior. It returns the generation the partition was (or became)
+// owned under, for the caller to pass to ValidGeneration later.
+func (c *ConsumerGroup) waitForPartitionOwnership() uint64 {
+	for {
+		owner := c.coordinator.OwnerOf(c.partition)
+		if owner == "" || c.getReceiver(owner) != nil {
+			return c.coordinator.Generation()
+		}
+		<-c.coordinator.Changed()
+	}
+}
+
+// dispatchBroadcast independently offers m to every Subscribe-created
+// receiver whose filter matches it. Unlike the round-robin rotation
+// used for Consume's competing receivers, each matching subscription is
+// meant to see its own copy of every message it's interested in, so
+// there's no "first one reached in rotation wins" here. A subscriber
+// over its high watermark has this message dropped for it rather than
+// stalling every other receiver in the group, since unlike round-robin
+// there's no alternate receiver to redirect a broadcast message to.
+func (c *ConsumerGroup) dispatchBroadcast(m *sgproto.Message) {
+	c.mu.RLock()
+	receivers := append([]*receiver(nil), c.receivers...)
+	c.mu.RUnlock()
+
+	for _, r := range receivers {
+		if !r.broadcast || !r.filter.Match(m) {
+			continue
+		}
+		if r.queue.ShouldPause() {
+			continue
+		}
+
+		select {
+		case <-r.doneCh:
+			c.removeConsumer(r.name)
+		case r.queue.out <- m:
+		}
+	}
+}
+
+func shouldRedeliver(index sandflake.ID, state sgproto.MarkState, policy RetryPolicy) bool {
 	switch state.Kind {
 	case sgproto.MarkKind_NotAcknowledged:
 		return true
 	case sgproto.MarkKind_Consumed, sgproto.MarkKind_Unknown: // inflight
-		return index.Time().Add(RedeliveryTimeout).Before(time.Now().UTC())
+		return index.Time().Add(policy.backoff(int(state.DeliveryCount))).Before(time.Now().UTC())
 	case sgproto.MarkKind_Acknowledged, sgproto.MarkKind_Commited:
 		return false
 	default:
@@ -270,6 +497,7 @@ func (c *ConsumerGroup) removeConsumer(name string) bool {
 	for i, r := range c.receivers {
 		if r.name == name {
 			c.receivers = append(c.receivers[:i], c.receivers[i+1:]...)
+			c.coordinator.Leave(name)
 			return true
 		}
 	}
@@ -289,8 +517,38 @@ func (c *ConsumerGroup) getReceiver(consumerName string) *receiver {
 	return nil
 }
 
-func (c *ConsumerGroup) Consume(consumerName string) (<-chan *sgproto.Message, chan<- struct{}, error) {
-	r := c.register(consumerName)
+// AckRevocation tells the group's coordinator that consumerName has
+// finished flushing in-flight work for the partitions named in the
+// EventRevoked it received at generation, letting a cooperative
+// rebalance hand those partitions to their new owner. It is a no-op if
+// generation is no longer the coordinator's pending plan, which happens
+// if another rebalance already superseded it. Eager rebalances don't
+// use this two-phase handoff, so calling it outside COOPERATIVE is
+// harmless but unnecessary.
+func (c *ConsumerGroup) AckRevocation(consumerName string, generation uint64) {
+	c.coordinator.CompleteRevocation(consumerName, generation)
+}
+
+// Consume registers consumerName with the group's coordinator and
+// returns the channel of messages assigned to it, a channel to signal
+// it is done consuming, and a channel of GroupEvents reporting which
+// partitions it has been assigned or asked to revoke. Clients should
+// finish any in-flight work for a partition named in an EventRevoked,
+// then call AckRevocation with that event's Generation, before
+// returning from their receive loop; until they do, a cooperative
+// rebalance leaves the revoked partitions with their current owner
+// rather than risking two consumers owning them at once.
+//
+// Messages are buffered per receiver in a ProcessQueue sized by
+// WithPrefetchCount (DefaultPrefetchCount if omitted), so a slow
+// consumer no longer blocks dispatch to the rest of the group.
+func (c *ConsumerGroup) Consume(consumerName string, opts ...ConsumeOption) (<-chan *sgproto.Message, chan<- struct{}, <-chan GroupEvent, error) {
+	cfg := consumeOptions{prefetchCount: DefaultPrefetchCount}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	r := c.register(consumerName, []RebalanceProtocol{EagerProtocol, CooperativeProtocol}, cfg.prefetchCount, matchAllFilter{}, false)
 
-	return r.msgCh, r.doneCh, nil
+	return r.queue.Out(), r.doneCh, r.events, nil
 }
@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/gogo/protobuf/proto"
+
+	"github.com/celrenheit/sandglass-grpc/go/sgproto"
+)
+
+// RetryPolicy controls how long ConsumerGroup waits before redelivering
+// an unacknowledged message, and what happens once it has been
+// redelivered more times than MaxDeliveryAttempts allows.
+type RetryPolicy struct {
+	MaxDeliveryAttempts int
+	BackoffInitial      time.Duration
+	BackoffMax          time.Duration
+	BackoffMultiplier   float64
+	DeadLetterTopic     string
+}
+
+// DefaultRetryPolicy keeps the historical fixed RedeliveryTimeout as its
+// starting backoff, doubling up to 5 minutes, and never dead-letters
+// (MaxDeliveryAttempts of 0 means unlimited, matching the old behavior).
+var DefaultRetryPolicy = RetryPolicy{
+	MaxDeliveryAttempts: 0,
+	BackoffInitial:      RedeliveryTimeout,
+	BackoffMax:          5 * time.Minute,
+	BackoffMultiplier:   2,
+}
+
+// backoff computes min(BackoffMax, BackoffInitial * BackoffMultiplier^attempt).
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	if p.BackoffInitial <= 0 {
+		return RedeliveryTimeout
+	}
+
+	d := time.Duration(float64(p.BackoffInitial) * math.Pow(p.BackoffMultiplier, float64(attempt)))
+	if p.BackoffMax > 0 && d > p.BackoffMax {
+		return p.BackoffMax
+	}
+	return d
+}
+
+// exhausted reports whether state has already been redelivered as many
+// times as this policy allows.
+func (p RetryPolicy) exhausted(state sgproto.MarkState) bool {
+	return p.MaxDeliveryAttempts > 0 && int(state.DeliveryCount) >= p.MaxDeliveryAttempts
+}
+
+// sendToDeadLetter re-produces m to the policy's DeadLetterTopic,
+// preserving its original headers plus x-original-topic,
+// x-original-partition, x-death-reason and x-death-count, then marks m
+// Acknowledged in the offset store so it is never redelivered again.
+// markMsg is the MarkState message previously fetched for m via
+// GetMarkStateMessage.
+func (c *ConsumerGroup) sendToDeadLetter(ctx context.Context, m, markMsg *sgproto.Message, state sgproto.MarkState) error {
+	headers := make(map[string]string, len(m.Headers)+4)
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	headers["x-original-topic"] = c.topic
+	headers["x-original-partition"] = c.partition
+	headers["x-death-reason"] = "max delivery attempts exceeded"
+	headers["x-death-count"] = strconv.Itoa(int(state.DeliveryCount))
+
+	dead := &sgproto.Message{
+		Key:     m.Key,
+		Value:   m.Value,
+		Headers: headers,
+	}
+
+	if _, err := c.broker.Produce(ctx, &sgproto.ProduceMessageRequest{
+		Topic:    c.retryPolicy.DeadLetterTopic,
+		Messages: []*sgproto.Message{dead},
+	}); err != nil {
+		return err
+	}
+
+	state.Kind = sgproto.MarkKind_Acknowledged
+	value, err := proto.Marshal(&state)
+	if err != nil {
+		return err
+	}
+	markMsg.Value = value
+
+	_, err = c.broker.Produce(ctx, &sgproto.ProduceMessageRequest{
+		Topic:    ConsumerOffsetTopicName,
+		Messages: []*sgproto.Message{markMsg},
+	})
+	return err
+}
+
+// DeadLetterConsumerGroup returns a ConsumerGroup over this group's
+// configured dead-letter topic, so applications can inspect or
+// reprocess messages that exhausted their retry budget instead of
+// having to know the DLQ topic name out of band.
+func (c *ConsumerGroup) DeadLetterConsumerGroup(consumerName string) (*ConsumerGroup, error) {
+	if c.retryPolicy.DeadLetterTopic == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "group %s has no dead-letter topic configured", c.name)
+	}
+
+	return NewConsumerGroup(c.broker, c.retryPolicy.DeadLetterTopic, c.partition, consumerName), nil
+}
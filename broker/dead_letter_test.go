@@ -0,0 +1,56 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/celrenheit/sandglass-grpc/go/sgproto"
+)
+
+func TestRetryPolicyBackoffGrowsAndCaps(t *testing.T) {
+	p := RetryPolicy{
+		BackoffInitial:    time.Second,
+		BackoffMax:        10 * time.Second,
+		BackoffMultiplier: 2,
+	}
+
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{4, 10 * time.Second}, // would be 16s uncapped
+	}
+
+	for _, c := range cases {
+		if got := p.backoff(c.attempt); got != c.want {
+			t.Errorf("backoff(%d) = %v, want %v", c.attempt, got, c.want)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffFallsBackToRedeliveryTimeout(t *testing.T) {
+	p := RetryPolicy{}
+	if got := p.backoff(0); got != RedeliveryTimeout {
+		t.Fatalf("backoff with no BackoffInitial = %v, want %v", got, RedeliveryTimeout)
+	}
+}
+
+func TestRetryPolicyExhausted(t *testing.T) {
+	p := RetryPolicy{MaxDeliveryAttempts: 3}
+
+	if p.exhausted(sgproto.MarkState{DeliveryCount: 2}) {
+		t.Fatal("should not be exhausted before reaching MaxDeliveryAttempts")
+	}
+	if !p.exhausted(sgproto.MarkState{DeliveryCount: 3}) {
+		t.Fatal("should be exhausted once DeliveryCount reaches MaxDeliveryAttempts")
+	}
+
+	unlimited := RetryPolicy{MaxDeliveryAttempts: 0}
+	if unlimited.exhausted(sgproto.MarkState{DeliveryCount: 1000}) {
+		t.Fatal("MaxDeliveryAttempts of 0 should mean unlimited redelivery")
+	}
+}
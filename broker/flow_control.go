@@ -0,0 +1,101 @@
+package broker
+
+import (
+	"sync"
+
+	"github.com/celrenheit/sandglass-grpc/go/sgproto"
+)
+
+// DefaultPrefetchCount is the ProcessQueue capacity used when a Consume
+// call doesn't specify one via WithPrefetchCount.
+const DefaultPrefetchCount = 1000
+
+const (
+	highWatermarkRatio = 0.8
+	lowWatermarkRatio  = 0.2
+)
+
+// ProcessQueue is a bounded, per-receiver buffer sitting between the
+// dispatch loop in consumeLoop and a consumer's receive channel. It
+// replaces the old unbuffered msgCh, which meant one slow consumer
+// head-of-line-blocked delivery to every other receiver in the group.
+//
+// HighWatermark/LowWatermark give the dispatcher hysteresis: once a
+// queue's backlog crosses HighWatermark the dispatcher stops filling it
+// and moves on to other receivers; it only resumes once the backlog has
+// drained back to LowWatermark or below.
+type ProcessQueue struct {
+	out           chan *sgproto.Message
+	highWatermark int
+	lowWatermark  int
+
+	mu     sync.Mutex
+	paused bool
+}
+
+// NewProcessQueue creates a queue with the given capacity. A
+// non-positive prefetchCount falls back to DefaultPrefetchCount.
+func NewProcessQueue(prefetchCount int) *ProcessQueue {
+	if prefetchCount <= 0 {
+		prefetchCount = DefaultPrefetchCount
+	}
+
+	high := int(float64(prefetchCount) * highWatermarkRatio)
+	if high < 1 {
+		high = 1
+	}
+	low := int(float64(prefetchCount) * lowWatermarkRatio)
+
+	return &ProcessQueue{
+		out:           make(chan *sgproto.Message, prefetchCount),
+		highWatermark: high,
+		lowWatermark:  low,
+	}
+}
+
+// Out returns the channel consumers read delivered messages from.
+func (q *ProcessQueue) Out() <-chan *sgproto.Message {
+	return q.out
+}
+
+// Len reports the number of messages currently buffered, i.e. the
+// receiver's in-flight count.
+func (q *ProcessQueue) Len() int {
+	return len(q.out)
+}
+
+// ShouldPause reports whether the dispatcher should stop filling this
+// queue. It is stateful: once the backlog crosses HighWatermark it
+// keeps returning true until the backlog drains to LowWatermark, so
+// the dispatcher doesn't flap between pausing and resuming on every
+// message.
+func (q *ProcessQueue) ShouldPause() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	backlog := len(q.out)
+	switch {
+	case !q.paused && backlog >= q.highWatermark:
+		q.paused = true
+	case q.paused && backlog <= q.lowWatermark:
+		q.paused = false
+	}
+
+	return q.paused
+}
+
+// ConsumeOption customizes a single Consume call, e.g. its prefetch
+// buffer size.
+type ConsumeOption func(*consumeOptions)
+
+type consumeOptions struct {
+	prefetchCount int
+}
+
+// WithPrefetchCount overrides the receiver's ProcessQueue capacity for
+// this Consume call.
+func WithPrefetchCount(n int) ConsumeOption {
+	return func(o *consumeOptions) {
+		o.prefetchCount = n
+	}
+}
@@ -0,0 +1,44 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/celrenheit/sandglass-grpc/go/sgproto"
+)
+
+func TestProcessQueueShouldPauseHysteresis(t *testing.T) {
+	q := NewProcessQueue(10) // highWatermark=8, lowWatermark=2
+
+	for i := 0; i < 7; i++ {
+		q.out <- &sgproto.Message{}
+	}
+	if q.ShouldPause() {
+		t.Fatal("should not pause below the high watermark")
+	}
+
+	for i := 0; i < 2; i++ {
+		q.out <- &sgproto.Message{}
+	}
+	if !q.ShouldPause() {
+		t.Fatal("should pause once the backlog reaches the high watermark")
+	}
+
+	for i := 0; i < 6; i++ {
+		<-q.out
+	}
+	if !q.ShouldPause() {
+		t.Fatal("should keep pausing until the backlog drains to the low watermark")
+	}
+
+	<-q.out
+	if q.ShouldPause() {
+		t.Fatal("should resume once the backlog drains to the low watermark")
+	}
+}
+
+func TestNewProcessQueueDefaultsPrefetchCount(t *testing.T) {
+	q := NewProcessQueue(0)
+	if cap(q.out) != DefaultPrefetchCount {
+		t.Fatalf("expected default prefetch count %d, got %d", DefaultPrefetchCount, cap(q.out))
+	}
+}
@@ -0,0 +1,834 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/celrenheit/sandflake"
+	"github.com/celrenheit/sandglass-grpc/go/sgproto"
+)
+
+// RebalanceProtocol is negotiated between the members of a group as the
+// intersection of the protocols they each support. COOPERATIVE allows
+// members to keep consuming the partitions they are not losing while a
+// rebalance is in progress; EAGER revokes everything up front like the
+// historical behavior.
+type RebalanceProtocol string
+
+const (
+	EagerProtocol       RebalanceProtocol = "EAGER"
+	CooperativeProtocol RebalanceProtocol = "COOPERATIVE"
+)
+
+// GroupMember is a single consumer registered against a GroupCoordinator.
+type GroupMember struct {
+	ID        string
+	Protocols []RebalanceProtocol
+}
+
+func (m *GroupMember) supports(p RebalanceProtocol) bool {
+	for _, candidate := range m.Protocols {
+		if candidate == p {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupEventType distinguishes assignment from revocation notifications
+// delivered to a consumer through its Consume channel.
+type GroupEventType int
+
+const (
+	EventAssigned GroupEventType = iota
+	EventRevoked
+)
+
+// GroupEvent notifies a consumer that the set of partitions it owns has
+// changed. Under the COOPERATIVE protocol, revocation events are
+// delivered before the partitions are handed to their new owner, so
+// clients get a chance to flush any in-flight work tied to that
+// partition. Under EAGER no EventRevoked is sent: each member receives
+// its whole new assignment in one EventAssigned.
+type GroupEvent struct {
+	Type       GroupEventType
+	Partitions []string
+	Generation uint64
+}
+
+// BalanceStrategy computes how a topic's partitions should be spread
+// across the members of a group. previous is the partitions owned by
+// each member before this Plan call and may be nil on the very first
+// assignment.
+type BalanceStrategy interface {
+	Name() string
+	Plan(members []*GroupMember, partitions []string, previous map[string][]string) map[string][]string
+}
+
+func sortedMemberIDs(members []*GroupMember) []string {
+	ids := make([]string, len(members))
+	for i, m := range members {
+		ids[i] = m.ID
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// RangeBalanceStrategy assigns contiguous ranges of partitions to each
+// member, in sorted partition and member order.
+type RangeBalanceStrategy struct{}
+
+func (RangeBalanceStrategy) Name() string { return "range" }
+
+func (RangeBalanceStrategy) Plan(members []*GroupMember, partitions []string, _ map[string][]string) map[string][]string {
+	assignment := make(map[string][]string, len(members))
+	if len(members) == 0 {
+		return assignment
+	}
+
+	ids := sortedMemberIDs(members)
+	sorted := append([]string(nil), partitions...)
+	sort.Strings(sorted)
+
+	n := len(sorted)
+	per := n / len(ids)
+	extra := n % len(ids)
+
+	offset := 0
+	for i, id := range ids {
+		count := per
+		if i < extra {
+			count++
+		}
+		assignment[id] = append([]string(nil), sorted[offset:offset+count]...)
+		offset += count
+	}
+
+	return assignment
+}
+
+// RoundRobinBalanceStrategy hands out partitions to members one at a
+// time in sorted order, ignoring any previous assignment.
+type RoundRobinBalanceStrategy struct{}
+
+func (RoundRobinBalanceStrategy) Name() string { return "round-robin" }
+
+func (RoundRobinBalanceStrategy) Plan(members []*GroupMember, partitions []string, _ map[string][]string) map[string][]string {
+	assignment := make(map[string][]string, len(members))
+	if len(members) == 0 {
+		return assignment
+	}
+
+	ids := sortedMemberIDs(members)
+	sorted := append([]string(nil), partitions...)
+	sort.Strings(sorted)
+
+	for i, p := range sorted {
+		id := ids[i%len(ids)]
+		assignment[id] = append(assignment[id], p)
+	}
+
+	return assignment
+}
+
+// StickyBalanceStrategy tries to preserve as much of the previous
+// assignment as possible while keeping the number of partitions per
+// member balanced, so a rebalance caused by one member joining or
+// leaving reshuffles as few partitions as possible.
+type StickyBalanceStrategy struct{}
+
+func (StickyBalanceStrategy) Name() string { return "sticky" }
+
+func (s StickyBalanceStrategy) Plan(members []*GroupMember, partitions []string, previous map[string][]string) map[string][]string {
+	return stickyPlan(members, partitions, previous)
+}
+
+// stickyPlan is shared between StickyBalanceStrategy and
+// CooperativeStickyBalanceStrategy: both want the same final
+// assignment, they only differ in how the transition to it is staged.
+func stickyPlan(members []*GroupMember, partitions []string, previous map[string][]string) map[string][]string {
+	assignment := make(map[string][]string, len(members))
+	if len(members) == 0 {
+		return assignment
+	}
+
+	ids := sortedMemberIDs(members)
+	memberIndex := make(map[string]int, len(ids))
+	for i, id := range ids {
+		memberIndex[id] = i
+		assignment[id] = nil
+	}
+
+	unassigned := make(map[string]bool, len(partitions))
+	for _, p := range partitions {
+		unassigned[p] = true
+	}
+
+	target := len(partitions) / len(ids)
+	extra := len(partitions) % len(ids)
+	targetFor := func(i int) int {
+		if i < extra {
+			return target + 1
+		}
+		return target
+	}
+
+	// keep everything that is still valid (the partition still exists
+	// and the owning member is still in the group), up to the member's
+	// target share.
+	for id, owned := range previous {
+		i, ok := memberIndex[id]
+		if !ok {
+			continue
+		}
+		for _, p := range owned {
+			if unassigned[p] && len(assignment[id]) < targetFor(i) {
+				assignment[id] = append(assignment[id], p)
+				delete(unassigned, p)
+			}
+		}
+	}
+
+	remaining := make([]string, 0, len(unassigned))
+	for p := range unassigned {
+		remaining = append(remaining, p)
+	}
+	sort.Strings(remaining)
+
+	// hand out the leftovers to whichever member is furthest below its
+	// target share, so the final assignment stays balanced.
+	for _, p := range remaining {
+		best := -1
+		bestDeficit := 0
+		for i, id := range ids {
+			deficit := targetFor(i) - len(assignment[id])
+			if deficit > bestDeficit {
+				best = i
+				bestDeficit = deficit
+			}
+		}
+		if best == -1 {
+			best = 0
+		}
+		assignment[ids[best]] = append(assignment[ids[best]], p)
+	}
+
+	return assignment
+}
+
+// CooperativeStickyBalanceStrategy computes the same target assignment
+// as StickyBalanceStrategy. When the negotiated protocol is COOPERATIVE,
+// GroupCoordinator stages the move to it over two rebalance rounds:
+// members first revoke only the partitions they are losing, then the
+// freed partitions are assigned to their new owners once every
+// revocation has been acknowledged. The staging is chosen by the
+// protocol, not the strategy, so it applies to every strategy alike.
+type CooperativeStickyBalanceStrategy struct{}
+
+func (CooperativeStickyBalanceStrategy) Name() string { return "cooperative-sticky" }
+
+func (CooperativeStickyBalanceStrategy) Plan(members []*GroupMember, partitions []string, previous map[string][]string) map[string][]string {
+	return stickyPlan(members, partitions, previous)
+}
+
+// pendingRevocation tracks a cooperative-sticky rebalance that has
+// handed out revocations but not yet assigned the freed partitions to
+// their new owners.
+type pendingRevocation struct {
+	generation uint64
+	target     map[string][]string
+	waitingFor map[string]bool
+}
+
+// GroupMembershipTopicName is the well-known topic GroupCoordinator uses
+// to publish membership heartbeats, so every broker in the cluster
+// learns about members that joined through a different broker process.
+// Like ConsumerOffsetTopicName, it relies on the broker's normal
+// per-partition replication to make membership durable and visible
+// cluster-wide.
+var GroupMembershipTopicName = "__consumer_group_membership"
+
+// membershipPartition is the single partition GroupCoordinator produces
+// and scans for every group; records for a given (topic, group) are
+// told apart by the prefix of their message key, not by partition.
+const membershipPartition = "0"
+
+// membershipPollInterval controls how often a GroupCoordinator refreshes
+// its view of the cluster-wide membership topic.
+var membershipPollInterval = 2 * time.Second
+
+// membershipTTL is how long a member can go without heartbeating before
+// a GroupCoordinator treats it as gone, independently of that member
+// ever publishing a left=true record (e.g. if its process crashed).
+var membershipTTL = 3 * membershipPollInterval
+
+// membershipRecord is the wire format heartbeated to
+// GroupMembershipTopicName. It is deliberately independent of sgproto:
+// membership is internal bookkeeping for this package, not something
+// other services need to decode.
+type membershipRecord struct {
+	Member    string   `json:"member"`
+	Protocols []string `json:"protocols"`
+	Left      bool     `json:"left"`
+}
+
+// GroupCoordinator tracks the membership of a consumer group across the
+// cluster and decides, via a pluggable BalanceStrategy, which partitions
+// of a topic each member should consume. Every GroupCoordinator for the
+// same (topic, group) name, on any broker in the cluster, periodically
+// publishes and reads the same replicated GroupMembershipTopicName log,
+// so they all see the same member list; since BalanceStrategy.Plan is a
+// pure function of that member list, the partitions, and the previously
+// observed assignment, independent coordinator instances converge on
+// the same assignment without needing a single elected leader.
+type GroupCoordinator struct {
+	broker   *Broker
+	topic    string
+	name     string
+	strategy BalanceStrategy
+
+	mu         sync.Mutex
+	generation uint64
+	protocol   RebalanceProtocol
+	members    map[string]*GroupMember
+	partitions []string
+	assignment map[string][]string
+	events     map[string]chan GroupEvent
+	pending    *pendingRevocation
+	changed    chan struct{}
+}
+
+// sharedCoordinators holds the one GroupCoordinator per (topic, group)
+// name pair live in this process, so every ConsumerGroup opened against
+// a different partition of the same topic shares a single coordinator
+// instead of each computing an assignment blind to the topic's other
+// partitions. Entries are refcounted and freed once the last
+// ConsumerGroup using them Closes.
+var (
+	sharedCoordinatorsMu sync.Mutex
+	sharedCoordinators   = make(map[string]*sharedCoordinator)
+)
+
+type sharedCoordinator struct {
+	gc   *GroupCoordinator
+	refs int
+}
+
+// acquireGroupCoordinator returns the GroupCoordinator shared by every
+// ConsumerGroup for (topic, name) in this process, creating it on first
+// use. The second return value is true when this call created it, so
+// the caller knows to start its background membership sync instead of
+// every partition's ConsumerGroup starting a redundant one.
+func acquireGroupCoordinator(b *Broker, topic, name string) (*GroupCoordinator, bool) {
+	key := topic + "|" + name
+
+	sharedCoordinatorsMu.Lock()
+	defer sharedCoordinatorsMu.Unlock()
+
+	sc, ok := sharedCoordinators[key]
+	if !ok {
+		sc = &sharedCoordinator{gc: NewGroupCoordinator(b, topic, name, nil)}
+		sharedCoordinators[key] = sc
+	}
+	sc.refs++
+	return sc.gc, !ok
+}
+
+// releaseGroupCoordinator drops this process's reference to the
+// (topic, name) coordinator acquired via acquireGroupCoordinator,
+// freeing it once no ConsumerGroup in this process uses it any more.
+func releaseGroupCoordinator(topic, name string) {
+	key := topic + "|" + name
+
+	sharedCoordinatorsMu.Lock()
+	defer sharedCoordinatorsMu.Unlock()
+
+	sc, ok := sharedCoordinators[key]
+	if !ok {
+		return
+	}
+	sc.refs--
+	if sc.refs <= 0 {
+		delete(sharedCoordinators, key)
+	}
+}
+
+// NewGroupCoordinator creates a coordinator for the given topic/group
+// name pair. strategy defaults to CooperativeStickyBalanceStrategy when
+// nil, which keeps each member's prior partitions where it can. b may
+// be nil for a coordinator that only ever sees members
+// joining through this process (e.g. in tests); membership sync with
+// the rest of the cluster is then simply skipped.
+func NewGroupCoordinator(b *Broker, topic, name string, strategy BalanceStrategy) *GroupCoordinator {
+	if strategy == nil {
+		strategy = CooperativeStickyBalanceStrategy{}
+	}
+
+	return &GroupCoordinator{
+		broker:     b,
+		topic:      topic,
+		name:       name,
+		strategy:   strategy,
+		members:    make(map[string]*GroupMember),
+		assignment: make(map[string][]string),
+		events:     make(map[string]chan GroupEvent),
+	}
+}
+
+// membershipKey prefixes every membership record key for this
+// coordinator's (topic, group) pair, so a single shared
+// GroupMembershipTopicName can carry every group's heartbeats.
+func (gc *GroupCoordinator) membershipKey() string {
+	return gc.topic + "|" + gc.name + "|"
+}
+
+// heartbeat publishes memberID's current membership record so every
+// other GroupCoordinator for this group, wherever in the cluster it is
+// running, picks it up on its next poll.
+func (gc *GroupCoordinator) heartbeat(memberID string, protocols []RebalanceProtocol, left bool) {
+	if gc.broker == nil {
+		return
+	}
+
+	protoNames := make([]string, len(protocols))
+	for i, p := range protocols {
+		protoNames[i] = string(p)
+	}
+
+	value, err := json.Marshal(membershipRecord{Member: memberID, Protocols: protoNames, Left: left})
+	if err != nil {
+		return
+	}
+
+	_, _ = gc.broker.Produce(context.TODO(), &sgproto.ProduceMessageRequest{
+		Topic: GroupMembershipTopicName,
+		Messages: []*sgproto.Message{{
+			Key:   []byte(gc.membershipKey() + memberID),
+			Value: value,
+		}},
+	})
+}
+
+// refreshMembership scans GroupMembershipTopicName for every record
+// belonging to this coordinator's group, folds in any member that
+// joined through a different broker process, drops any member that
+// hasn't heartbeated within membershipTTL or has published a left
+// record, and triggers a Rebalance if anything changed.
+func (gc *GroupCoordinator) refreshMembership() {
+	if gc.broker == nil {
+		return
+	}
+
+	prefix := gc.membershipKey()
+	type sighting struct {
+		protocols []RebalanceProtocol
+		lastSeen  time.Time
+	}
+	seen := make(map[string]sighting)
+
+	now := sandflake.NewID(time.Now().UTC(), sandflake.MaxID.WorkerID(), sandflake.MaxID.Sequence(), sandflake.MaxID.RandomBytes())
+	req := &sgproto.FetchRangeRequest{
+		Topic:     GroupMembershipTopicName,
+		Partition: membershipPartition,
+		From:      sandflake.ID{},
+		To:        now,
+	}
+
+	_ = gc.broker.FetchRange(context.TODO(), req, func(m *sgproto.Message) error {
+		key := string(m.Key)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		var record membershipRecord
+		if err := json.Unmarshal(m.Value, &record); err != nil {
+			return nil
+		}
+
+		if record.Left {
+			delete(seen, record.Member)
+			return nil
+		}
+
+		ts := m.Offset.Time()
+		if existing, ok := seen[record.Member]; ok && existing.lastSeen.After(ts) {
+			return nil // an older record arriving after a newer one; keep the newer
+		}
+
+		protocols := make([]RebalanceProtocol, len(record.Protocols))
+		for i, p := range record.Protocols {
+			protocols[i] = RebalanceProtocol(p)
+		}
+		seen[record.Member] = sighting{protocols: protocols, lastSeen: ts}
+
+		return nil
+	})
+
+	nowTime := time.Now().UTC()
+	gc.mu.Lock()
+	changed := false
+	for id, s := range seen {
+		if nowTime.Sub(s.lastSeen) > membershipTTL {
+			continue // hasn't heartbeated recently enough to be considered live
+		}
+		if _, ok := gc.members[id]; ok {
+			continue
+		}
+		gc.members[id] = &GroupMember{ID: id, Protocols: s.protocols}
+		changed = true
+	}
+	for id := range gc.members {
+		if _, local := gc.events[id]; local {
+			continue // joined through this process; always authoritative for itself
+		}
+		if s, ok := seen[id]; ok && nowTime.Sub(s.lastSeen) <= membershipTTL {
+			continue
+		}
+		delete(gc.members, id)
+		delete(gc.assignment, id)
+		changed = true
+	}
+	if changed {
+		gc.protocol = gc.negotiateProtocolLocked()
+	}
+	gc.mu.Unlock()
+
+	if changed {
+		gc.Rebalance()
+	}
+}
+
+// startMembershipSync periodically re-heartbeats this process's own
+// members and refreshes the view of everyone else's from
+// GroupMembershipTopicName until stopCh is closed. It is a no-op when
+// the coordinator has no broker to read from.
+func (gc *GroupCoordinator) startMembershipSync(stopCh <-chan struct{}) {
+	if gc.broker == nil {
+		return
+	}
+
+	ticker := time.NewTicker(membershipPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			gc.heartbeatLocalMembers()
+			gc.refreshMembership()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// heartbeatLocalMembers re-publishes a membership record for every
+// member that joined through this process. Join only heartbeats once,
+// so without this a member's record ages past membershipTTL and gets
+// evicted by every other broker's coordinator every few seconds even
+// though it never left.
+func (gc *GroupCoordinator) heartbeatLocalMembers() {
+	gc.mu.Lock()
+	local := make([]*GroupMember, 0, len(gc.events))
+	for id := range gc.events {
+		if m, ok := gc.members[id]; ok {
+			local = append(local, m)
+		}
+	}
+	gc.mu.Unlock()
+
+	for _, m := range local {
+		gc.heartbeat(m.ID, m.Protocols, false)
+	}
+}
+
+// Join registers a member, negotiates the RebalanceProtocol used for the
+// group, and triggers a rebalance. The returned channel receives
+// assignment and revocation events for the lifetime of the membership.
+func (gc *GroupCoordinator) Join(memberID string, protocols []RebalanceProtocol) <-chan GroupEvent {
+	gc.mu.Lock()
+	gc.members[memberID] = &GroupMember{ID: memberID, Protocols: protocols}
+	ch := make(chan GroupEvent, 8)
+	gc.events[memberID] = ch
+	gc.protocol = gc.negotiateProtocolLocked()
+	gc.mu.Unlock()
+
+	gc.heartbeat(memberID, protocols, false)
+	gc.Rebalance()
+
+	return ch
+}
+
+// Leave removes a member from the group and triggers a rebalance of its
+// former partitions onto the remaining members.
+func (gc *GroupCoordinator) Leave(memberID string) {
+	gc.mu.Lock()
+	protocols := []RebalanceProtocol{}
+	if m, ok := gc.members[memberID]; ok {
+		protocols = m.Protocols
+	}
+	delete(gc.members, memberID)
+	if ch, ok := gc.events[memberID]; ok {
+		close(ch)
+		delete(gc.events, memberID)
+	}
+	delete(gc.assignment, memberID)
+	gc.protocol = gc.negotiateProtocolLocked()
+	gc.mu.Unlock()
+
+	gc.heartbeat(memberID, protocols, true)
+	gc.Rebalance()
+}
+
+func (gc *GroupCoordinator) negotiateProtocolLocked() RebalanceProtocol {
+	protocol := CooperativeProtocol
+	for _, m := range gc.members {
+		if !m.supports(CooperativeProtocol) {
+			protocol = EagerProtocol
+		}
+	}
+	return protocol
+}
+
+// SetPartitions replaces the set of partitions the coordinator is
+// allowed to assign, then triggers a rebalance. Most callers only know
+// about their own partition as it comes and goes, so in production code
+// AddPartition/RemovePartition are what ConsumerGroup actually uses;
+// SetPartitions is for callers (and tests) that already have the full
+// list up front.
+func (gc *GroupCoordinator) SetPartitions(partitions []string) {
+	gc.mu.Lock()
+	gc.partitions = append([]string(nil), partitions...)
+	gc.mu.Unlock()
+
+	gc.Rebalance()
+}
+
+// AddPartition registers partition as one this coordinator may assign,
+// e.g. when a ConsumerGroup for a new partition of the topic starts up
+// in this process. It is a no-op if partition is already known.
+func (gc *GroupCoordinator) AddPartition(partition string) {
+	gc.mu.Lock()
+	for _, p := range gc.partitions {
+		if p == partition {
+			gc.mu.Unlock()
+			return
+		}
+	}
+	gc.partitions = append(gc.partitions, partition)
+	gc.mu.Unlock()
+
+	gc.Rebalance()
+}
+
+// RemovePartition unregisters partition, e.g. when its ConsumerGroup is
+// Closed. Whichever member it was assigned to loses it on the next
+// rebalance.
+func (gc *GroupCoordinator) RemovePartition(partition string) {
+	gc.mu.Lock()
+	kept := gc.partitions[:0]
+	for _, p := range gc.partitions {
+		if p != partition {
+			kept = append(kept, p)
+		}
+	}
+	gc.partitions = kept
+	gc.mu.Unlock()
+
+	gc.Rebalance()
+}
+
+// Rebalance recomputes the target assignment and notifies members of
+// whatever changed. Under the cooperative protocol the recompute only
+// revokes the partitions that are moving; the matching EventAssigned is
+// sent once CompleteRevocation confirms every losing member gave up its
+// partitions, so an in-progress move never double-assigns a partition.
+//
+// Each call computes a fresh plan from the current members and
+// assignment, replacing any plan still waiting on CompleteRevocation.
+// Leave has already dropped a departed member from the assignment, so a
+// member leaving mid-rebalance can't strand the group forever waiting
+// for an ack it will never send.
+func (gc *GroupCoordinator) Rebalance() error {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if len(gc.members) == 0 {
+		gc.pending = nil
+		return nil
+	}
+
+	if gc.pending != nil {
+		for id := range gc.pending.waitingFor {
+			if _, stillMember := gc.members[id]; !stillMember {
+				delete(gc.pending.waitingFor, id)
+			}
+		}
+		if len(gc.pending.waitingFor) == 0 {
+			gc.pending = nil
+		}
+	}
+
+	memberList := make([]*GroupMember, 0, len(gc.members))
+	for _, m := range gc.members {
+		memberList = append(memberList, m)
+	}
+
+	target := gc.strategy.Plan(memberList, gc.partitions, gc.assignment)
+	gc.generation++
+	generation := gc.generation
+
+	if gc.protocol != CooperativeProtocol {
+		gc.assignment = target
+		gc.pending = nil
+		gc.notifyChangedLocked()
+		for id, ch := range gc.events {
+			ch <- GroupEvent{Type: EventAssigned, Partitions: target[id], Generation: generation}
+		}
+		return nil
+	}
+
+	pending := &pendingRevocation{generation: generation, target: target, waitingFor: make(map[string]bool)}
+	for id, owned := range gc.assignment {
+		revoked := diff(owned, target[id])
+		if len(revoked) == 0 {
+			continue
+		}
+		if ch, ok := gc.events[id]; ok {
+			ch <- GroupEvent{Type: EventRevoked, Partitions: revoked, Generation: generation}
+		}
+		pending.waitingFor[id] = true
+	}
+
+	if len(pending.waitingFor) == 0 {
+		for id, ch := range gc.events {
+			gained := diff(target[id], gc.assignment[id])
+			// a member's first assignment is reported even when empty
+			_, hadAssignment := gc.assignment[id]
+			if len(gained) > 0 || !hadAssignment {
+				ch <- GroupEvent{Type: EventAssigned, Partitions: gained, Generation: generation}
+			}
+		}
+		gc.assignment = target
+		gc.pending = nil
+		gc.notifyChangedLocked()
+		return nil
+	}
+
+	gc.pending = pending
+	return nil
+}
+
+// CompleteRevocation is called by a member once it has flushed in-flight
+// work for the partitions it was asked to revoke. Once every member in
+// the pending plan has confirmed, the freed partitions are assigned to
+// their new owners in a second round. ConsumerGroup exposes this as
+// AckRevocation; it is never called automatically, since only the
+// application knows when it has actually finished flushing a revoked
+// partition's in-flight work.
+func (gc *GroupCoordinator) CompleteRevocation(memberID string, generation uint64) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if gc.pending == nil || gc.pending.generation != generation {
+		return // stale confirmation from an earlier, already-superseded plan
+	}
+
+	delete(gc.pending.waitingFor, memberID)
+	if len(gc.pending.waitingFor) > 0 {
+		return
+	}
+
+	target := gc.pending.target
+	for id, ch := range gc.events {
+		gained := diff(target[id], gc.assignment[id])
+		if len(gained) > 0 {
+			ch <- GroupEvent{Type: EventAssigned, Partitions: gained, Generation: generation}
+		}
+	}
+	gc.assignment = target
+	gc.pending = nil
+	gc.notifyChangedLocked()
+}
+
+// notifyChangedLocked wakes up anyone blocked in Changed() on the
+// assignment that was just replaced. gc.mu must be held.
+func (gc *GroupCoordinator) notifyChangedLocked() {
+	if gc.changed != nil {
+		close(gc.changed)
+	}
+	gc.changed = make(chan struct{})
+}
+
+// Changed returns a channel that is closed the next time Rebalance or
+// CompleteRevocation installs a new assignment, so a caller can wait
+// for ownership of a partition to change instead of polling OwnerOf in
+// a busy loop.
+func (gc *GroupCoordinator) Changed() <-chan struct{} {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if gc.changed == nil {
+		gc.changed = make(chan struct{})
+	}
+	return gc.changed
+}
+
+// Assignment returns the partitions currently owned by memberID.
+func (gc *GroupCoordinator) Assignment(memberID string) []string {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return append([]string(nil), gc.assignment[memberID]...)
+}
+
+// OwnerOf reports which member currently owns partition, or "" if it is
+// unassigned (e.g. no rebalance has run yet).
+func (gc *GroupCoordinator) OwnerOf(partition string) string {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	for id, owned := range gc.assignment {
+		for _, p := range owned {
+			if p == partition {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// Generation returns the coordinator's current generation ID. Commits
+// carrying an older generation must be rejected, since they come from a
+// member that no longer owns the partition it is trying to commit.
+func (gc *GroupCoordinator) Generation() uint64 {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.generation
+}
+
+// ValidGeneration reports whether generation is still current, letting
+// callers reject stale commits from members evicted by a later
+// rebalance.
+func (gc *GroupCoordinator) ValidGeneration(generation uint64) bool {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return generation == gc.generation
+}
+
+func diff(from, without []string) []string {
+	excluded := make(map[string]bool, len(without))
+	for _, p := range without {
+		excluded[p] = true
+	}
+
+	out := make([]string, 0, len(from))
+	for _, p := range from {
+		if !excluded[p] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
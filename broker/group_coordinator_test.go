@@ -0,0 +1,159 @@
+package broker
+
+import "testing"
+
+func TestCooperativeStickyBalanceStrategyPlan(t *testing.T) {
+	members := []*GroupMember{{ID: "a"}, {ID: "b"}}
+	partitions := []string{"p0", "p1", "p2", "p3"}
+
+	target := CooperativeStickyBalanceStrategy{}.Plan(members, partitions, nil)
+
+	total := len(target["a"]) + len(target["b"])
+	if total != len(partitions) {
+		t.Fatalf("expected all %d partitions assigned, got %d", len(partitions), total)
+	}
+	if len(target["a"]) == 0 || len(target["b"]) == 0 {
+		t.Fatalf("expected both members to get partitions, got a=%v b=%v", target["a"], target["b"])
+	}
+}
+
+// TestGroupCoordinatorCooperativeRebalanceHandsOffPartitions exercises
+// the full two-phase cooperative handoff: a second member joining must
+// not receive its share of the partitions until the first member acks
+// the revocation it was sent, and it must receive them once it does.
+func TestGroupCoordinatorCooperativeRebalanceHandsOffPartitions(t *testing.T) {
+	gc := NewGroupCoordinator(nil, "orders", "billing", CooperativeStickyBalanceStrategy{})
+	gc.SetPartitions([]string{"p0", "p1", "p2", "p3"})
+
+	events1 := gc.Join("consumer-1", []RebalanceProtocol{EagerProtocol, CooperativeProtocol})
+
+	select {
+	case ev := <-events1:
+		if ev.Type != EventAssigned || len(ev.Partitions) != 4 {
+			t.Fatalf("expected consumer-1 to be assigned all 4 partitions initially, got %+v", ev)
+		}
+	default:
+		t.Fatal("expected an initial assignment event for consumer-1")
+	}
+
+	events2 := gc.Join("consumer-2", []RebalanceProtocol{EagerProtocol, CooperativeProtocol})
+
+	var revoked []string
+	select {
+	case ev := <-events1:
+		if ev.Type != EventRevoked {
+			t.Fatalf("expected consumer-1 to be asked to revoke partitions, got %+v", ev)
+		}
+		revoked = ev.Partitions
+	default:
+		t.Fatal("expected a revocation event for consumer-1 once consumer-2 joined")
+	}
+	if len(revoked) == 0 {
+		t.Fatal("expected consumer-1 to be asked to revoke at least one partition")
+	}
+
+	select {
+	case ev := <-events2:
+		t.Fatalf("consumer-2 should not be assigned anything before the revocation is acked, got %+v", ev)
+	default:
+	}
+
+	gc.CompleteRevocation("consumer-1", gc.Generation())
+
+	select {
+	case ev := <-events2:
+		if ev.Type != EventAssigned || len(ev.Partitions) == 0 {
+			t.Fatalf("expected consumer-2 to be assigned the revoked partitions, got %+v", ev)
+		}
+	default:
+		t.Fatal("expected consumer-2 to be assigned once consumer-1 acked its revocation")
+	}
+
+	if got := gc.Assignment("consumer-1"); len(got)+len(gc.Assignment("consumer-2")) != 4 {
+		t.Fatalf("expected all 4 partitions to still be owned between both members, got consumer-1=%v consumer-2=%v", got, gc.Assignment("consumer-2"))
+	}
+}
+
+// TestGroupCoordinatorRebalanceSelfHealsAfterMemberLeavesMidRevocation
+// makes sure a member leaving while its revocation is still pending
+// doesn't strand the plan forever: the departure itself must trigger
+// the delayed assignment instead of requiring an ack that will never
+// come.
+func TestGroupCoordinatorRebalanceSelfHealsAfterMemberLeavesMidRevocation(t *testing.T) {
+	gc := NewGroupCoordinator(nil, "orders", "billing", CooperativeStickyBalanceStrategy{})
+	gc.SetPartitions([]string{"p0", "p1"})
+
+	events1 := gc.Join("consumer-1", []RebalanceProtocol{EagerProtocol, CooperativeProtocol})
+	<-events1 // initial assignment of both partitions
+
+	events2 := gc.Join("consumer-2", []RebalanceProtocol{EagerProtocol, CooperativeProtocol})
+	<-events1 // revocation, never acked
+
+	gc.Leave("consumer-1")
+
+	select {
+	case ev := <-events2:
+		if ev.Type != EventAssigned || len(ev.Partitions) == 0 {
+			t.Fatalf("expected consumer-2 to be assigned once consumer-1 left, got %+v", ev)
+		}
+	default:
+		t.Fatal("expected consumer-1 leaving to release the stuck revocation and assign consumer-2")
+	}
+}
+
+// TestGroupCoordinatorAddPartitionRebalancesAcrossAllPartitions makes
+// sure a coordinator that learns about a topic's partitions one at a
+// time via AddPartition (the way every partition's ConsumerGroup
+// registers itself) ends up balancing across all of them, not just
+// whichever partition happened to call SetPartitions first.
+func TestGroupCoordinatorAddPartitionRebalancesAcrossAllPartitions(t *testing.T) {
+	gc := NewGroupCoordinator(nil, "orders", "billing", nil)
+
+	events := gc.Join("consumer-1", []RebalanceProtocol{EagerProtocol, CooperativeProtocol})
+	<-events // empty initial assignment, no partitions yet
+
+	gc.AddPartition("p0")
+	<-events
+	gc.AddPartition("p1")
+	<-events
+
+	if got := gc.Assignment("consumer-1"); len(got) != 2 {
+		t.Fatalf("expected consumer-1 to own both partitions added so far, got %v", got)
+	}
+
+	gc.RemovePartition("p0")
+	<-events // revocation of p0
+	gc.CompleteRevocation("consumer-1", gc.Generation())
+
+	if got := gc.Assignment("consumer-1"); len(got) != 1 || got[0] != "p1" {
+		t.Fatalf("expected only p1 to remain assigned after RemovePartition, got %v", got)
+	}
+}
+
+// TestGroupCoordinatorOwnerOfAndChanged makes sure OwnerOf reflects the
+// current assignment and Changed unblocks once a rebalance replaces it,
+// which is what ConsumerGroup's dispatch loop relies on to pause
+// delivery for a partition owned elsewhere.
+func TestGroupCoordinatorOwnerOfAndChanged(t *testing.T) {
+	gc := NewGroupCoordinator(nil, "orders", "billing", nil)
+
+	if owner := gc.OwnerOf("p0"); owner != "" {
+		t.Fatalf("expected p0 to be unowned before any member joins, got %q", owner)
+	}
+
+	events := gc.Join("consumer-1", []RebalanceProtocol{EagerProtocol, CooperativeProtocol})
+	<-events
+
+	waiting := gc.Changed()
+	gc.AddPartition("p0")
+
+	select {
+	case <-waiting:
+	default:
+		t.Fatal("expected Changed's previous channel to be closed once AddPartition triggered a rebalance")
+	}
+
+	if owner := gc.OwnerOf("p0"); owner != "consumer-1" {
+		t.Fatalf("expected p0 to be owned by consumer-1, got %q", owner)
+	}
+}
@@ -0,0 +1,274 @@
+package broker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/celrenheit/sandflake"
+
+	"github.com/celrenheit/sandglass-grpc/go/sgproto"
+)
+
+// OffsetKey identifies the offset of one consumer group against one
+// topic partition.
+type OffsetKey struct {
+	Topic     string
+	Partition string
+	Group     string
+}
+
+// OffsetStore persists and retrieves consumer offsets. It replaces the
+// ad-hoc mix of broker.Commit/broker.MarkConsumed calls that used to be
+// scattered across consumeLoop, so offset persistence can be swapped
+// out independently of the dispatch logic.
+type OffsetStore interface {
+	// ReadOffset returns the last persisted offset for key, or the zero
+	// sandflake.ID if none has been persisted yet.
+	ReadOffset(ctx context.Context, key OffsetKey) (sandflake.ID, error)
+	// UpdateOffset records offset, and an opaque metadata string
+	// alongside it (e.g. a caller-defined checkpoint marker), as the
+	// current position for key. It may only update in-memory/buffered
+	// state; Persist is what guarantees durability.
+	UpdateOffset(ctx context.Context, key OffsetKey, offset sandflake.ID, metadata string) error
+	// Persist flushes any buffered offset for key to durable storage.
+	Persist(ctx context.Context, key OffsetKey) error
+	// Remove resets key's position back to the beginning, e.g. so a
+	// group can be told to reprocess a partition from scratch. The
+	// underlying log is append-only, so this does not erase any
+	// previously committed offset history, only the group's resumption
+	// point; any buffered (not yet persisted) offset for key is also
+	// discarded.
+	Remove(ctx context.Context, key OffsetKey) error
+}
+
+// offsetEntry is a dirty/pending offset paired with the metadata
+// MarkOffset was called with, so Persist has something to carry through
+// to broker.Commit alongside the offset itself.
+type offsetEntry struct {
+	offset   sandflake.ID
+	metadata string
+}
+
+// LocalOffsetStore persists offsets by producing MarkState messages to
+// ConsumerOffsetTopicName on the local broker, the same mechanism
+// consumeLoop used to drive inline.
+type LocalOffsetStore struct {
+	broker *Broker
+
+	mu    sync.Mutex
+	dirty map[OffsetKey]offsetEntry
+}
+
+func NewLocalOffsetStore(b *Broker) *LocalOffsetStore {
+	return &LocalOffsetStore{
+		broker: b,
+		dirty:  make(map[OffsetKey]offsetEntry),
+	}
+}
+
+func (s *LocalOffsetStore) ReadOffset(ctx context.Context, key OffsetKey) (sandflake.ID, error) {
+	s.mu.Lock()
+	if entry, ok := s.dirty[key]; ok {
+		s.mu.Unlock()
+		return entry.offset, nil
+	}
+	s.mu.Unlock()
+
+	return s.broker.LastOffset(ctx, key.Topic, key.Partition, key.Group, "", sgproto.MarkKind_Commited)
+}
+
+func (s *LocalOffsetStore) UpdateOffset(ctx context.Context, key OffsetKey, offset sandflake.ID, metadata string) error {
+	s.mu.Lock()
+	s.dirty[key] = offsetEntry{offset: offset, metadata: metadata}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *LocalOffsetStore) Persist(ctx context.Context, key OffsetKey) error {
+	s.mu.Lock()
+	entry, ok := s.dirty[key]
+	if ok {
+		delete(s.dirty, key)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	_, err := s.broker.Commit(ctx, key.Topic, key.Partition, key.Group, entry.metadata, entry.offset)
+	return err
+}
+
+// Remove resets key back to the zero offset by marking it consumed from
+// scratch; see OffsetStore.Remove for why this isn't a real delete.
+func (s *LocalOffsetStore) Remove(ctx context.Context, key OffsetKey) error {
+	s.mu.Lock()
+	delete(s.dirty, key)
+	s.mu.Unlock()
+
+	_, err := s.broker.MarkConsumed(ctx, key.Topic, key.Partition, key.Group, "", sandflake.ID{})
+	return err
+}
+
+// RemoteOffsetStore buffers offset updates and flushes them in
+// batches, so a consumer that marks offsets at a high rate doesn't
+// produce one message per ack to the offset topic.
+type RemoteOffsetStore struct {
+	broker   *Broker
+	batchMax int
+
+	mu      sync.Mutex
+	pending map[OffsetKey]offsetEntry
+}
+
+// NewRemoteOffsetStore creates a store whose PersistAll walks the
+// buffered offsets batchMax keys at a time; a batchMax of 0 or less
+// treats them all as one batch. Persist commits a single key.
+func NewRemoteOffsetStore(b *Broker, batchMax int) *RemoteOffsetStore {
+	return &RemoteOffsetStore{
+		broker:   b,
+		batchMax: batchMax,
+		pending:  make(map[OffsetKey]offsetEntry),
+	}
+}
+
+func (s *RemoteOffsetStore) ReadOffset(ctx context.Context, key OffsetKey) (sandflake.ID, error) {
+	s.mu.Lock()
+	if entry, ok := s.pending[key]; ok {
+		s.mu.Unlock()
+		return entry.offset, nil
+	}
+	s.mu.Unlock()
+
+	return s.broker.LastOffset(ctx, key.Topic, key.Partition, key.Group, "", sgproto.MarkKind_Commited)
+}
+
+func (s *RemoteOffsetStore) UpdateOffset(ctx context.Context, key OffsetKey, offset sandflake.ID, metadata string) error {
+	s.mu.Lock()
+	s.pending[key] = offsetEntry{offset: offset, metadata: metadata}
+	s.mu.Unlock()
+	return nil
+}
+
+// Persist commits the buffered offset for key, if any, and drops it
+// from the pending set; other keys are left buffered.
+func (s *RemoteOffsetStore) Persist(ctx context.Context, key OffsetKey) error {
+	s.mu.Lock()
+	entry, ok := s.pending[key]
+	if ok {
+		delete(s.pending, key)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	_, err := s.broker.Commit(ctx, key.Topic, key.Partition, key.Group, entry.metadata, entry.offset)
+	return err
+}
+
+// PersistAll flushes every buffered offset, batchMax keys at a time.
+func (s *RemoteOffsetStore) PersistAll(ctx context.Context) error {
+	s.mu.Lock()
+	keys := make([]OffsetKey, 0, len(s.pending))
+	for k := range s.pending {
+		keys = append(keys, k)
+	}
+	s.mu.Unlock()
+
+	batch := s.batchMax
+	if batch <= 0 {
+		batch = len(keys)
+	}
+
+	for i := 0; i < len(keys); i += batch {
+		end := i + batch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		for _, k := range keys[i:end] {
+			if err := s.Persist(ctx, k); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Remove resets key back to the zero offset by marking it consumed from
+// scratch; see OffsetStore.Remove for why this isn't a real delete.
+func (s *RemoteOffsetStore) Remove(ctx context.Context, key OffsetKey) error {
+	s.mu.Lock()
+	delete(s.pending, key)
+	s.mu.Unlock()
+
+	_, err := s.broker.MarkConsumed(ctx, key.Topic, key.Partition, key.Group, "", sandflake.ID{})
+	return err
+}
+
+// AutoCommitConfig controls the background offset-flushing goroutine
+// started by ConsumerGroup when Enabled is true. It replaces the old
+// hardcoded "commit every 10000 messages" heuristic in consumeLoop.
+type AutoCommitConfig struct {
+	Enabled  bool
+	Interval time.Duration
+}
+
+var DefaultAutoCommitConfig = AutoCommitConfig{
+	Enabled:  true,
+	Interval: 5 * time.Second,
+}
+
+func (c *ConsumerGroup) offsetKey() OffsetKey {
+	return OffsetKey{Topic: c.topic, Partition: c.partition, Group: c.name}
+}
+
+// MarkOffset records metadata and marks msg's offset as the current
+// position for the group, without necessarily persisting it yet; that
+// happens on the next auto-commit tick or an explicit CommitOffsets, at
+// which point metadata is committed alongside the offset itself.
+func (c *ConsumerGroup) MarkOffset(msg *sgproto.Message, metadata string) error {
+	return c.offsetStore.UpdateOffset(context.TODO(), c.offsetKey(), msg.Offset, metadata)
+}
+
+// ResetOffset forces the group's position for (topic, partition) back
+// to offset, e.g. to replay messages after fixing a consumer bug.
+func (c *ConsumerGroup) ResetOffset(topic, partition string, offset sandflake.ID) error {
+	key := OffsetKey{Topic: topic, Partition: partition, Group: c.name}
+	if err := c.offsetStore.UpdateOffset(context.TODO(), key, offset, ""); err != nil {
+		return err
+	}
+	return c.offsetStore.Persist(context.TODO(), key)
+}
+
+// CommitOffsets flushes the group's buffered offset to the underlying
+// OffsetStore immediately.
+func (c *ConsumerGroup) CommitOffsets() error {
+	return c.offsetStore.Persist(context.TODO(), c.offsetKey())
+}
+
+// startAutoCommit runs until stopCh is closed, periodically flushing
+// buffered offsets according to cfg.
+func (c *ConsumerGroup) startAutoCommit(cfg AutoCommitConfig, stopCh <-chan struct{}) {
+	if !cfg.Enabled {
+		return
+	}
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.CommitOffsets(); err != nil {
+				c.broker.Debug("auto-commit failed for %s/%s/%s: %v", c.topic, c.partition, c.name, err)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package broker
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/celrenheit/sandglass-grpc/go/sgproto"
+)
+
+// KeyFunc extracts the ordering key from a message for ConsumeOrdered.
+// A nil KeyFunc falls back to msg.Key.
+type KeyFunc func(m *sgproto.Message) []byte
+
+func defaultKeyFunc(m *sgproto.Message) []byte {
+	return m.Key
+}
+
+// rendezvousOwner picks the receiver that hashes highest for key among
+// receivers (highest random weight / HRW hashing). Unlike a mod-based
+// hash, losing or gaining a receiver only reshuffles the keys that
+// hashed to the member that changed, not the whole keyspace.
+func rendezvousOwner(receivers []*receiver, key string) *receiver {
+	var (
+		best    *receiver
+		bestVal uint64
+	)
+
+	for _, r := range receivers {
+		h := fnv.New64a()
+		h.Write([]byte(r.name))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		v := h.Sum64()
+
+		if best == nil || v > bestVal {
+			best, bestVal = r, v
+		}
+	}
+
+	return best
+}
+
+// orderedQueue is a single key's pending-message buffer and worker
+// goroutine. senders tracks how many dispatch calls are currently
+// between claiming the entry and finishing their send to ch, so run's
+// idle reaper can tell "empty channel" apart from "a message is about
+// to land in it" and never drops one.
+type orderedQueue struct {
+	ch      chan *sgproto.Message
+	senders int
+}
+
+// orderedDispatcher gives ConsumeOrdered its per-key FIFO guarantee. Each
+// key gets its own persistent worker goroutine draining a buffered
+// channel in the order messages were enqueued, so ordering comes from
+// the channel itself rather than from goroutines racing to reacquire a
+// lock; messages with different keys are not blocked on one another,
+// since each key's worker runs independently, until one key has
+// orderedQueueSize messages buffered, at which point dispatch blocks
+// for every key. A key's worker and entry
+// are reaped after orderedKeyIdleTimeout of inactivity, so the map and
+// goroutine count track the currently-active keys, not every key ever
+// seen.
+type orderedDispatcher struct {
+	c     *ConsumerGroup
+	keyFn KeyFunc
+
+	mu    sync.Mutex
+	queue map[string]*orderedQueue
+	ackCh map[string]chan struct{} // the in-flight message's ack gate, per key
+}
+
+func newOrderedDispatcher(c *ConsumerGroup, keyFn KeyFunc) *orderedDispatcher {
+	if keyFn == nil {
+		keyFn = defaultKeyFunc
+	}
+	return &orderedDispatcher{
+		c:     c,
+		keyFn: keyFn,
+		queue: make(map[string]*orderedQueue),
+		ackCh: make(map[string]chan struct{}),
+	}
+}
+
+// orderedQueueSize bounds how many not-yet-delivered messages a single
+// key can have buffered in its worker's queue before dispatch blocks;
+// it only needs to be large enough to smooth over normal delivery
+// latency; a key whose consumer falls permanently behind should pause
+// the group instead of growing this without bound.
+const orderedQueueSize = 256
+
+// orderedKeyIdleTimeout bounds how long a key's worker goroutine stays
+// alive with nothing queued before it exits and frees the key's entry.
+// Without this, a high-cardinality key space (one key per order ID, per
+// user ID, etc.) leaks one goroutine and one map entry per distinct key
+// for the life of the process. A var, not a const, so tests can shorten
+// it instead of waiting out the real timeout.
+var orderedKeyIdleTimeout = 30 * time.Second
+
+// dispatch enqueues m for its key in arrival order, starting that key's
+// worker goroutine the first time the key is seen (or is seen again
+// after its previous worker was reaped for being idle).
+func (d *orderedDispatcher) dispatch(m *sgproto.Message) {
+	key := string(d.keyFn(m))
+
+	d.mu.Lock()
+	q, ok := d.queue[key]
+	if !ok {
+		q = &orderedQueue{ch: make(chan *sgproto.Message, orderedQueueSize)}
+		d.queue[key] = q
+		go d.run(key, q)
+	}
+	q.senders++
+	d.mu.Unlock()
+
+	q.ch <- m
+
+	d.mu.Lock()
+	q.senders--
+	d.mu.Unlock()
+}
+
+// run delivers messages for key strictly in the order dispatch enqueued
+// them onto q.ch, waiting for each to be acked via release before
+// moving on to the next -- the channel, not a lock race, is what
+// guarantees the ordering. It exits and frees key's entry once
+// orderedKeyIdleTimeout passes with nothing queued and no dispatch call
+// in the middle of sending.
+func (d *orderedDispatcher) run(key string, q *orderedQueue) {
+	timer := time.NewTimer(orderedKeyIdleTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case m := <-q.ch:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			d.deliverAndAwaitAck(key, m)
+			timer.Reset(orderedKeyIdleTimeout)
+
+		case <-timer.C:
+			d.mu.Lock()
+			if len(q.ch) > 0 || q.senders > 0 {
+				// a message is queued or mid-send; not actually idle.
+				d.mu.Unlock()
+				timer.Reset(orderedKeyIdleTimeout)
+				continue
+			}
+			delete(d.queue, key)
+			d.mu.Unlock()
+			return
+		}
+	}
+}
+
+// deliverAndAwaitAck hands m to deliver and, if it was accepted by a
+// receiver, blocks until release acks it before returning.
+func (d *orderedDispatcher) deliverAndAwaitAck(key string, m *sgproto.Message) {
+	// register the gate before delivering, so a release that races
+	// ahead of this goroutine still finds it
+	ack := make(chan struct{})
+	d.mu.Lock()
+	d.ackCh[key] = ack
+	d.mu.Unlock()
+
+	if !d.deliver(key, m) {
+		d.mu.Lock()
+		delete(d.ackCh, key)
+		d.mu.Unlock()
+		return // every receiver was removed while delivering; drop and move on
+	}
+
+	<-ack
+}
+
+// deliver hands m to its rendezvous-hashed receiver, falling back to the
+// remaining receivers (and removing the dead one via removeConsumer, the
+// same cleanup Consume's round-robin path performs) if the chosen
+// receiver has signaled doneCh. It reports false once no receiver is
+// left to take m.
+func (d *orderedDispatcher) deliver(key string, m *sgproto.Message) bool {
+	for {
+		d.c.mu.RLock()
+		receivers := append([]*receiver(nil), d.c.receivers...)
+		d.c.mu.RUnlock()
+
+		if len(receivers) == 0 {
+			return false
+		}
+
+		r := rendezvousOwner(receivers, key)
+
+		select {
+		case <-r.doneCh:
+			d.c.removeConsumer(r.name)
+			continue // that receiver is gone; rendezvous over whoever is left
+		case r.queue.out <- m:
+			return true
+		}
+	}
+}
+
+// release acks the in-flight message for m's key, letting that key's
+// worker dispatch the next queued message.
+func (d *orderedDispatcher) release(m *sgproto.Message) {
+	key := string(d.keyFn(m))
+
+	d.mu.Lock()
+	ack, ok := d.ackCh[key]
+	delete(d.ackCh, key)
+	d.mu.Unlock()
+
+	if ok {
+		close(ack)
+	}
+}
+
+// ConsumeOrdered behaves like Consume, except messages sharing the same
+// key (as extracted by keyFn) are always routed to the same receiver,
+// in the order they were dispatched, and the next message for a given
+// key is only handed out once AckOrdered has been called for the
+// previous one. Messages with different keys are dispatched
+// concurrently, so this gives per-key FIFO semantics without
+// serializing the whole partition. A nil keyFn defaults to msg.Key.
+func (c *ConsumerGroup) ConsumeOrdered(consumerName string, keyFn KeyFunc, opts ...ConsumeOption) (<-chan *sgproto.Message, chan<- struct{}, <-chan GroupEvent, error) {
+	c.mu.Lock()
+	if c.ordered == nil {
+		c.ordered = newOrderedDispatcher(c, keyFn)
+	}
+	c.mu.Unlock()
+
+	return c.Consume(consumerName, opts...)
+}
+
+// AckOrdered releases the in-flight gate held for m's key, letting the
+// next message sharing that key be dispatched. It is a no-op if the
+// group was never put into ordered mode via ConsumeOrdered.
+func (c *ConsumerGroup) AckOrdered(m *sgproto.Message) {
+	c.mu.RLock()
+	ordered := c.ordered
+	c.mu.RUnlock()
+
+	if ordered == nil {
+		return
+	}
+
+	ordered.release(m)
+}
@@ -0,0 +1,167 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/celrenheit/sandglass-grpc/go/sgproto"
+)
+
+func newTestReceiver(name string, prefetch int) *receiver {
+	return &receiver{
+		name:   name,
+		queue:  NewProcessQueue(prefetch),
+		doneCh: make(chan struct{}),
+		filter: matchAllFilter{},
+	}
+}
+
+func newTestConsumerGroup(receivers ...*receiver) *ConsumerGroup {
+	return &ConsumerGroup{
+		topic:       "orders",
+		partition:   "0",
+		name:        "billing",
+		coordinator: NewGroupCoordinator(nil, "orders", "billing", nil),
+		receivers:   receivers,
+	}
+}
+
+// TestOrderedDispatcherPreservesPerKeyOrder makes sure a second message
+// sharing a key is never handed to the receiver before the first one
+// has been acked, which is what gives ConsumeOrdered real FIFO instead
+// of a race between goroutines.
+func TestOrderedDispatcherPreservesPerKeyOrder(t *testing.T) {
+	r := newTestReceiver("only", 10)
+	cg := newTestConsumerGroup(r)
+	d := newOrderedDispatcher(cg, nil)
+
+	m1 := &sgproto.Message{Key: []byte("k"), Value: []byte("first")}
+	m2 := &sgproto.Message{Key: []byte("k"), Value: []byte("second")}
+
+	d.dispatch(m1)
+	d.dispatch(m2)
+
+	select {
+	case got := <-r.queue.out:
+		if string(got.Value) != "first" {
+			t.Fatalf("expected first message delivered first, got %q", got.Value)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the first message")
+	}
+
+	select {
+	case got := <-r.queue.out:
+		t.Fatalf("second message delivered before the first was acked: %q", got.Value)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	d.release(m1)
+
+	select {
+	case got := <-r.queue.out:
+		if string(got.Value) != "second" {
+			t.Fatalf("expected second message after ack, got %q", got.Value)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the second message after ack")
+	}
+}
+
+// TestOrderedDispatcherSkipsDeadReceiver makes sure a receiver that has
+// signaled doneCh is removed and doesn't permanently wedge delivery for
+// keys that rendezvous-hash to it.
+func TestOrderedDispatcherSkipsDeadReceiver(t *testing.T) {
+	dead := newTestReceiver("dead", 10)
+	close(dead.doneCh)
+	alive := newTestReceiver("alive", 10)
+
+	cg := newTestConsumerGroup(dead, alive)
+	d := newOrderedDispatcher(cg, nil)
+
+	// Find a key that rendezvous-hashes to the dead receiver first, so
+	// dispatch actually has to route around it.
+	key := ""
+	for i := 0; ; i++ {
+		candidate := []byte{byte(i)}
+		if rendezvousOwner([]*receiver{dead, alive}, string(candidate)) == dead {
+			key = string(candidate)
+			break
+		}
+		if i == 255 {
+			t.Fatal("could not find a key that hashes to the dead receiver")
+		}
+	}
+
+	m := &sgproto.Message{Key: []byte(key), Value: []byte("hello")}
+	d.dispatch(m)
+
+	select {
+	case got := <-alive.queue.out:
+		if string(got.Value) != "hello" {
+			t.Fatalf("unexpected message delivered: %q", got.Value)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message never reached the surviving receiver")
+	}
+
+	cg.mu.RLock()
+	n := len(cg.receivers)
+	cg.mu.RUnlock()
+	if n != 1 {
+		t.Fatalf("expected the dead receiver to be removed, still have %d receivers", n)
+	}
+}
+
+// TestOrderedDispatcherReapsIdleKey makes sure a key's worker goroutine
+// and queue entry are freed once it has gone idle, instead of staying
+// around forever and leaking one goroutine per distinct key ever seen.
+func TestOrderedDispatcherReapsIdleKey(t *testing.T) {
+	old := orderedKeyIdleTimeout
+	orderedKeyIdleTimeout = 20 * time.Millisecond
+	defer func() { orderedKeyIdleTimeout = old }()
+
+	r := newTestReceiver("only", 10)
+	cg := newTestConsumerGroup(r)
+	d := newOrderedDispatcher(cg, nil)
+
+	m := &sgproto.Message{Key: []byte("k"), Value: []byte("first")}
+	d.dispatch(m)
+
+	select {
+	case <-r.queue.out:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the message")
+	}
+	d.release(m)
+
+	deadline := time.After(time.Second)
+	for {
+		d.mu.Lock()
+		_, stillThere := d.queue["k"]
+		d.mu.Unlock()
+		if !stillThere {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("key was never reaped after going idle")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+
+	// dispatching again for the same key must work as if it were brand
+	// new, i.e. reaping must not have left the dispatcher in a state
+	// where the key can no longer be delivered to.
+	m2 := &sgproto.Message{Key: []byte("k"), Value: []byte("second")}
+	d.dispatch(m2)
+
+	select {
+	case got := <-r.queue.out:
+		if string(got.Value) != "second" {
+			t.Fatalf("expected second message after reap, got %q", got.Value)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a message dispatched after the key was reaped")
+	}
+}
@@ -0,0 +1,133 @@
+package broker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/celrenheit/sandglass-grpc/go/sgproto"
+)
+
+func TestCompileTagFilter(t *testing.T) {
+	f, err := cachedFilter(&Filter{Type: FilterTypeTag, Expression: "env=prod,region=eu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match := &sgproto.Message{Headers: map[string]string{"env": "prod", "region": "eu"}}
+	if !f.Match(match) {
+		t.Fatal("expected message matching all tags to match")
+	}
+
+	noMatch := &sgproto.Message{Headers: map[string]string{"env": "staging", "region": "eu"}}
+	if f.Match(noMatch) {
+		t.Fatal("expected message with a differing tag to not match")
+	}
+}
+
+func TestCompileSQLFilter(t *testing.T) {
+	f, err := cachedFilter(&Filter{Type: FilterTypeSQL, Expression: "env = 'prod' AND region != 'us'"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.Match(&sgproto.Message{Headers: map[string]string{"env": "prod", "region": "eu"}}) {
+		t.Fatal("expected clauses to match")
+	}
+	if f.Match(&sgproto.Message{Headers: map[string]string{"env": "prod", "region": "us"}}) {
+		t.Fatal("expected the != clause to exclude region=us")
+	}
+}
+
+func TestCompileExprFilter(t *testing.T) {
+	f, err := cachedFilter(&Filter{Type: FilterTypeExpr, Expression: "env == 'prod' && tier != 'free'"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.Match(&sgproto.Message{Headers: map[string]string{"env": "prod", "tier": "paid"}}) {
+		t.Fatal("expected clauses to match")
+	}
+	if f.Match(&sgproto.Message{Headers: map[string]string{"env": "prod", "tier": "free"}}) {
+		t.Fatal("expected the != clause to exclude tier=free")
+	}
+}
+
+func TestCachedFilterReturnsSameInstanceForSameExpression(t *testing.T) {
+	a, err := cachedFilter(&Filter{Type: FilterTypeTag, Expression: "env=prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := cachedFilter(&Filter{Type: FilterTypeTag, Expression: "env=prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	af, ok := a.(tagFilter)
+	if !ok {
+		t.Fatalf("expected tagFilter, got %T", a)
+	}
+	bf, ok := b.(tagFilter)
+	if !ok {
+		t.Fatalf("expected tagFilter, got %T", b)
+	}
+	if len(af.tags) != len(bf.tags) {
+		t.Fatal("expected both compiles to produce equivalent filters")
+	}
+	if reflect.ValueOf(af.tags).Pointer() != reflect.ValueOf(bf.tags).Pointer() {
+		t.Fatal("expected the second call to return the cached filter, not a fresh compile")
+	}
+}
+
+func TestCachedFilterNilReturnsMatchAll(t *testing.T) {
+	f, err := cachedFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.(matchAllFilter); !ok {
+		t.Fatalf("expected matchAllFilter, got %T", f)
+	}
+}
+
+// TestDispatchBroadcastFansOutToEveryMatchingSubscription makes sure
+// two Subscribe receivers with different, both-matching filters on the
+// same group each get their own copy of a message, instead of only
+// whichever is reached first in a round-robin rotation.
+func TestDispatchBroadcastFansOutToEveryMatchingSubscription(t *testing.T) {
+	prod := newTestReceiver("prod-subscriber", 10)
+	prod.filter, _ = cachedFilter(&Filter{Type: FilterTypeTag, Expression: "env=prod"})
+	prod.broadcast = true
+
+	all := newTestReceiver("catch-all-subscriber", 10)
+	all.broadcast = true
+
+	competing := newTestReceiver("plain-consumer", 10)
+
+	cg := newTestConsumerGroup(prod, all, competing)
+
+	m := &sgproto.Message{Headers: map[string]string{"env": "prod"}}
+	cg.dispatchBroadcast(m)
+
+	select {
+	case got := <-prod.queue.out:
+		if got != m {
+			t.Fatalf("expected the prod subscriber to receive m")
+		}
+	default:
+		t.Fatal("expected the prod subscriber, whose filter matches, to receive a copy")
+	}
+
+	select {
+	case got := <-all.queue.out:
+		if got != m {
+			t.Fatalf("expected the catch-all subscriber to receive m")
+		}
+	default:
+		t.Fatal("expected the catch-all subscriber to also receive its own copy")
+	}
+
+	select {
+	case <-competing.queue.out:
+		t.Fatal("expected a plain Consume receiver to never be fed by dispatchBroadcast")
+	default:
+	}
+}